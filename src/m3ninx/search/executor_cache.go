@@ -0,0 +1,392 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/m3db/m3ninx/doc"
+	"github.com/m3db/m3ninx/postings"
+)
+
+// HashableQuery is a Query that can compute a stable structural hash of
+// itself. It is the cache key used by the query cache executor: two queries
+// that would match the same documents against the same index generation
+// must return the same hash.
+type HashableQuery interface {
+	Query
+
+	// Hash returns a stable structural hash of the query.
+	Hash() uint64
+}
+
+// GenerationSource reports a token that changes whenever the set of
+// index.Readers backing an Executor is swapped for a different generation,
+// letting the query cache invalidate entries computed against stale readers.
+type GenerationSource interface {
+	// Generation returns the current generation token.
+	Generation() uint64
+}
+
+// ReaderSetExecutor is an Executor that can additionally materialize a
+// doc.Iterator directly from a previously computed set of per-reader
+// postings lists, letting the query cache skip straight to iteration on a
+// cache hit rather than re-running the full query against every reader.
+type ReaderSetExecutor interface {
+	Executor
+	GenerationSource
+
+	// IteratorFromPostings returns a doc.Iterator over the given per-reader
+	// postings lists using the executor's current set of index.Readers.
+	IteratorFromPostings(pls []postings.List) (doc.Iterator, error)
+}
+
+// sizedPostingsList is implemented by postings.List values that know their
+// own approximate in-memory footprint.
+type sizedPostingsList interface {
+	postings.List
+
+	// SizeBytes returns the approximate number of bytes retained by the
+	// postings list.
+	SizeBytes() int
+}
+
+// bytesPerPosting approximates the footprint of a single posting ID for
+// postings.List implementations that don't report SizeBytes themselves.
+const bytesPerPosting = 8
+
+func postingsListSize(pl postings.List) int {
+	if sized, ok := pl.(sizedPostingsList); ok {
+		return sized.SizeBytes()
+	}
+	return pl.Len() * bytesPerPosting
+}
+
+func postingsListsSize(pls []postings.List) int {
+	size := 0
+	for _, pl := range pls {
+		size += postingsListSize(pl)
+	}
+	return size
+}
+
+// QueryCacheMetrics reports the runtime behavior of a query cache executor.
+type QueryCacheMetrics struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Bytes     int64
+}
+
+// ExecutorOption configures an Executor returned by NewExecutor.
+type ExecutorOption func(*executorOptions)
+
+type executorOptions struct {
+	queryCacheBytes int
+}
+
+// WithQueryCache bounds the executor's memoized query results to at most
+// bytes of total cached postings.List payloads, evicting least-recently-used
+// entries as needed. A single result larger than bytes is never cached.
+//
+// Executors wrapping the same generation of index.Readers share the same
+// underlying cache (see sharedQueryCache), so repeated calls to NewExecutor
+// for concurrent Executors over one reader set see each other's entries
+// instead of each paying for its own cold cache.
+func WithQueryCache(bytes int) ExecutorOption {
+	return func(opts *executorOptions) {
+		opts.queryCacheBytes = bytes
+	}
+}
+
+// NewExecutor wraps exec with the given options applied. If exec implements
+// ReaderSetExecutor and WithQueryCache is set, the returned Executor memoizes
+// results for any HashableQuery it is asked to execute; otherwise exec is
+// returned unwrapped.
+func NewExecutor(exec Executor, opts ...ExecutorOption) Executor {
+	var options executorOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.queryCacheBytes <= 0 {
+		return exec
+	}
+
+	rse, ok := exec.(ReaderSetExecutor)
+	if !ok {
+		return exec
+	}
+
+	return &cachedExecutor{
+		exec:     rse,
+		maxBytes: options.queryCacheBytes,
+	}
+}
+
+type cacheKey struct {
+	generation uint64
+	hash       uint64
+}
+
+// cachedExecutor is the Executor NewExecutor returns when query caching is
+// enabled. It holds no cache of its own: every call resolves the cache
+// registered for e.exec in the shared registry, so concurrent Executors
+// wrapping the same ReaderSetExecutor share one cache, and a generation
+// bump on e.exec retires only e.exec's own stale cache rather than leaving
+// its entries to be reclaimed lazily by LRU pressure - or, just as
+// importantly, rather than disturbing any other ReaderSetExecutor's cache,
+// since generation is just a per-reader-set counter and two independent
+// reader sets can legitimately report the same generation number.
+type cachedExecutor struct {
+	exec     ReaderSetExecutor
+	maxBytes int
+}
+
+func (e *cachedExecutor) Execute(q Query) (doc.Iterator, error) {
+	hq, ok := q.(HashableQuery)
+	if !ok {
+		return e.exec.Execute(q)
+	}
+
+	generation := e.exec.Generation()
+	cache := sharedQueryCache(e.exec, generation, e.maxBytes)
+
+	key := cacheKey{generation: generation, hash: hq.Hash()}
+	if pls, ok := cache.get(key); ok {
+		return e.exec.IteratorFromPostings(pls)
+	}
+
+	iter, err := e.exec.Execute(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if pi, ok := iter.(postingsIterator); ok {
+		pls, closers := pi.Postings()
+		cache.put(key, pls, closers)
+	}
+
+	return iter, nil
+}
+
+func (e *cachedExecutor) Close() error {
+	// The shared cache registered for e.exec is, per cachedExecutor's own
+	// contract, shared by every concurrent cachedExecutor wrapping the same
+	// ReaderSetExecutor - closing this wrapper must not tear it down out
+	// from under any sibling wrapper still live over the same exec. Its
+	// entry is retired lazily, the same way a generation bump retires it,
+	// rather than here.
+	return e.exec.Close()
+}
+
+// Metrics returns the current hit rate, byte occupancy, and eviction counts
+// for the cache backing e.exec.
+func (e *cachedExecutor) Metrics() QueryCacheMetrics {
+	return sharedQueryCache(e.exec, e.exec.Generation(), e.maxBytes).metrics()
+}
+
+// postingsIterator is implemented by doc.Iterator values that can expose the
+// per-reader postings lists driving them, along with the closers that
+// release any pooled buffers backing those lists, so the query cache can
+// memoize the lists and take over responsibility for closing them once it
+// evicts or overwrites the entry.
+type postingsIterator interface {
+	doc.Iterator
+
+	// Postings returns the postings lists underlying the iterator and their
+	// closers, transferring responsibility for calling those closers to the
+	// caller.
+	Postings() ([]postings.List, []io.Closer)
+}
+
+// sharedCacheEntry is the registry's bookkeeping for a single
+// ReaderSetExecutor: the generation its cache was built against, so a
+// generation bump on just that reader set can be detected and the stale
+// cache retired without touching any other reader set's entry.
+type sharedCacheEntry struct {
+	generation uint64
+	cache      *queryCache
+}
+
+var (
+	sharedCachesMu sync.Mutex
+	// sharedCaches is keyed by the ReaderSetExecutor identity rather than
+	// by the raw generation number: generation is only a monotonic counter
+	// scoped to a single reader set, so two unrelated indices can report
+	// the same generation value and must never be allowed to share or
+	// invalidate each other's cache.
+	sharedCaches = make(map[ReaderSetExecutor]*sharedCacheEntry)
+)
+
+// sharedQueryCache returns the byte-bounded query cache registered for exec
+// at generation, creating one bounded to maxBytes if exec has no entry yet
+// or its existing entry was built against a different (now stale)
+// generation. Retiring a stale generation only ever closes and discards
+// exec's own previous entry; every other ReaderSetExecutor's cache in the
+// registry is left untouched.
+func sharedQueryCache(exec ReaderSetExecutor, generation uint64, maxBytes int) *queryCache {
+	sharedCachesMu.Lock()
+	defer sharedCachesMu.Unlock()
+
+	if entry, ok := sharedCaches[exec]; ok {
+		if entry.generation == generation {
+			return entry.cache
+		}
+		entry.cache.invalidate()
+	}
+
+	cache := newQueryCache(maxBytes)
+	sharedCaches[exec] = &sharedCacheEntry{generation: generation, cache: cache}
+	return cache
+}
+
+// queryCache is a byte-bounded LRU cache of per-query postings.List results,
+// modeled on go-git's plumbing/cache buffer LRU: eviction is driven by total
+// payload bytes rather than entry count, and an entry larger than the
+// configured budget is never cached. Every cached entry's closers are
+// invoked exactly once, whenever that entry leaves the cache, whether by
+// eviction, overwrite, or invalidation.
+type queryCache struct {
+	mu        sync.Mutex
+	maxBytes  int
+	curBytes  int
+	entries   *list.List
+	index     map[cacheKey]*list.Element
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type queryCacheEntry struct {
+	key     cacheKey
+	values  []postings.List
+	closers []io.Closer
+	size    int
+}
+
+func newQueryCache(maxBytes int) *queryCache {
+	return &queryCache{
+		maxBytes: maxBytes,
+		entries:  list.New(),
+		index:    make(map[cacheKey]*list.Element),
+	}
+}
+
+func (c *queryCache) get(key cacheKey) ([]postings.List, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.index[key]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	c.entries.MoveToFront(elem)
+	atomic.AddInt64(&c.hits, 1)
+	return elem.Value.(*queryCacheEntry).values, true
+}
+
+func (c *queryCache) put(key cacheKey, pls []postings.List, closers []io.Closer) {
+	size := postingsListsSize(pls)
+	if size > c.maxBytes {
+		// Never cache a single entry larger than the configured budget;
+		// the caller retains responsibility for releasing these leases.
+		for _, closer := range closers {
+			closer.Close()
+		}
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.index[key]; ok {
+		old := elem.Value.(*queryCacheEntry)
+		for _, closer := range old.closers {
+			closer.Close()
+		}
+		c.curBytes += size - old.size
+		old.values = pls
+		old.closers = closers
+		old.size = size
+		c.entries.MoveToFront(elem)
+	} else {
+		entry := &queryCacheEntry{key: key, values: pls, closers: closers, size: size}
+		c.index[key] = c.entries.PushFront(entry)
+		c.curBytes += size
+	}
+
+	for c.curBytes > c.maxBytes {
+		back := c.entries.Back()
+		if back == nil {
+			break
+		}
+
+		c.removeElement(back)
+		c.evictions++
+	}
+}
+
+// removeElement removes elem from the cache's bookkeeping and releases its
+// leases. Callers must hold c.mu.
+func (c *queryCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*queryCacheEntry)
+	c.entries.Remove(elem)
+	delete(c.index, entry.key)
+	c.curBytes -= entry.size
+	for _, closer := range entry.closers {
+		closer.Close()
+	}
+}
+
+// invalidate drops every entry in the cache, releasing their leases. It is
+// used when the cache's generation has been superseded.
+func (c *queryCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		back := c.entries.Back()
+		if back == nil {
+			break
+		}
+		c.removeElement(back)
+	}
+}
+
+func (c *queryCache) metrics() QueryCacheMetrics {
+	c.mu.Lock()
+	bytes := c.curBytes
+	evictions := c.evictions
+	c.mu.Unlock()
+
+	return QueryCacheMetrics{
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Evictions: evictions,
+		Bytes:     int64(bytes),
+	}
+}
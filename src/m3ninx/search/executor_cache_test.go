@@ -0,0 +1,305 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"io"
+	"testing"
+
+	"github.com/m3db/m3ninx/doc"
+	"github.com/m3db/m3ninx/index"
+	"github.com/m3db/m3ninx/postings"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closerSpy counts how many times Close is called so tests can assert a
+// cache entry's leases are released exactly once.
+type closerSpy struct{ closes int }
+
+func (c *closerSpy) Close() error {
+	c.closes++
+	return nil
+}
+
+// fixedSizePostingsList reports a caller-chosen SizeBytes rather than
+// deriving one from Len, so eviction math in tests is exact.
+type fixedSizePostingsList struct {
+	postings.List
+	size int
+}
+
+func (pl fixedSizePostingsList) SizeBytes() int { return pl.size }
+
+func TestPostingsListSizePrefersSizeBytes(t *testing.T) {
+	pl := fixedSizePostingsList{List: fakePostingsList{n: 100}, size: 7}
+	assert.Equal(t, 7, postingsListSize(pl))
+}
+
+func TestQueryCachePutAndGet(t *testing.T) {
+	c := newQueryCache(1024)
+	key := cacheKey{generation: 1, hash: 42}
+	closer := &closerSpy{}
+
+	_, ok := c.get(key)
+	assert.False(t, ok)
+
+	c.put(key, []postings.List{fixedSizePostingsList{size: 10}}, []io.Closer{closer})
+
+	pls, ok := c.get(key)
+	require.True(t, ok)
+	require.Len(t, pls, 1)
+
+	m := c.metrics()
+	assert.Equal(t, int64(1), m.Hits)
+	assert.Equal(t, int64(1), m.Misses)
+	assert.Equal(t, int64(10), m.Bytes)
+	assert.Equal(t, 0, closer.closes)
+}
+
+func TestQueryCacheRejectsOversizedEntry(t *testing.T) {
+	c := newQueryCache(10)
+	closer := &closerSpy{}
+
+	c.put(cacheKey{hash: 1}, []postings.List{fixedSizePostingsList{size: 20}}, []io.Closer{closer})
+
+	_, ok := c.get(cacheKey{hash: 1})
+	assert.False(t, ok)
+	assert.Equal(t, 1, closer.closes)
+	assert.Equal(t, int64(0), c.metrics().Bytes)
+}
+
+func TestQueryCacheEvictsLRUByBytes(t *testing.T) {
+	c := newQueryCache(15)
+	closerA := &closerSpy{}
+	closerB := &closerSpy{}
+	closerC := &closerSpy{}
+
+	c.put(cacheKey{hash: 1}, []postings.List{fixedSizePostingsList{size: 10}}, []io.Closer{closerA})
+	c.put(cacheKey{hash: 2}, []postings.List{fixedSizePostingsList{size: 5}}, []io.Closer{closerB})
+
+	// Pushes total bytes to 18 > 15, evicting the least-recently-used entry
+	// (hash 1) to get back under budget.
+	c.put(cacheKey{hash: 3}, []postings.List{fixedSizePostingsList{size: 3}}, []io.Closer{closerC})
+
+	_, ok := c.get(cacheKey{hash: 1})
+	assert.False(t, ok)
+	assert.Equal(t, 1, closerA.closes)
+
+	_, ok = c.get(cacheKey{hash: 2})
+	assert.True(t, ok)
+	_, ok = c.get(cacheKey{hash: 3})
+	assert.True(t, ok)
+
+	assert.Equal(t, int64(1), c.metrics().Evictions)
+	assert.Equal(t, 0, closerB.closes)
+	assert.Equal(t, 0, closerC.closes)
+}
+
+func TestQueryCachePutOverwritesClosesOldCloser(t *testing.T) {
+	c := newQueryCache(1024)
+	key := cacheKey{hash: 1}
+	oldCloser := &closerSpy{}
+	newCloser := &closerSpy{}
+
+	c.put(key, []postings.List{fixedSizePostingsList{size: 5}}, []io.Closer{oldCloser})
+	c.put(key, []postings.List{fixedSizePostingsList{size: 5}}, []io.Closer{newCloser})
+
+	assert.Equal(t, 1, oldCloser.closes)
+	assert.Equal(t, 0, newCloser.closes)
+	assert.Equal(t, int64(5), c.metrics().Bytes)
+}
+
+func TestQueryCacheInvalidateClosesEveryEntry(t *testing.T) {
+	c := newQueryCache(1024)
+	closerA := &closerSpy{}
+	closerB := &closerSpy{}
+
+	c.put(cacheKey{hash: 1}, []postings.List{fixedSizePostingsList{size: 1}}, []io.Closer{closerA})
+	c.put(cacheKey{hash: 2}, []postings.List{fixedSizePostingsList{size: 1}}, []io.Closer{closerB})
+
+	c.invalidate()
+
+	assert.Equal(t, 1, closerA.closes)
+	assert.Equal(t, 1, closerB.closes)
+	assert.Equal(t, int64(0), c.metrics().Bytes)
+
+	_, ok := c.get(cacheKey{hash: 1})
+	assert.False(t, ok)
+}
+
+func TestSharedQueryCacheReturnsSameInstanceForSameExecAndGeneration(t *testing.T) {
+	exec := &fakeReaderSetExecutor{generation: 1001}
+
+	a := sharedQueryCache(exec, exec.generation, 1024)
+	b := sharedQueryCache(exec, exec.generation, 1024)
+
+	assert.Same(t, a, b)
+}
+
+func TestSharedQueryCacheInvalidatesOnlyItsOwnStaleGeneration(t *testing.T) {
+	exec := &fakeReaderSetExecutor{generation: 2001}
+
+	old := sharedQueryCache(exec, exec.generation, 1024)
+	closer := &closerSpy{}
+	old.put(cacheKey{generation: exec.generation, hash: 1}, []postings.List{fixedSizePostingsList{size: 1}}, []io.Closer{closer})
+
+	exec.generation = 2002
+
+	// Registering exec's new generation must retire exec's own stale
+	// cache, closing any leases it was still holding.
+	again := sharedQueryCache(exec, exec.generation, 1024)
+
+	assert.Equal(t, 1, closer.closes)
+	assert.NotSame(t, old, again)
+}
+
+func TestSharedQueryCacheDoesNotCollideAcrossDifferentExecutorsWithSameGeneration(t *testing.T) {
+	// Generation is only a per-reader-set counter; two independent
+	// ReaderSetExecutors can legitimately report the same value and must
+	// never be allowed to share, or invalidate, each other's cache.
+	execA := &fakeReaderSetExecutor{generation: 5}
+	execB := &fakeReaderSetExecutor{generation: 5}
+
+	cacheA := sharedQueryCache(execA, execA.generation, 1024)
+	closer := &closerSpy{}
+	cacheA.put(cacheKey{generation: 5, hash: 1}, []postings.List{fixedSizePostingsList{size: 1}}, []io.Closer{closer})
+
+	cacheB := sharedQueryCache(execB, execB.generation, 1024)
+
+	assert.NotSame(t, cacheA, cacheB)
+	// Looking up execB's cache must not have disturbed execA's entry.
+	assert.Equal(t, 0, closer.closes)
+	_, ok := cacheA.get(cacheKey{generation: 5, hash: 1})
+	assert.True(t, ok)
+}
+
+// fakeHashableQuery is a minimal HashableQuery for exercising cachedExecutor.
+type fakeHashableQuery struct{ hash uint64 }
+
+func (q fakeHashableQuery) Hash() uint64 { return q.hash }
+func (q fakeHashableQuery) Searcher(rs index.Readers) (Searcher, error) {
+	return nil, nil
+}
+
+// fakePostingsIterator is a doc.Iterator that also exposes the postings
+// lists and closers driving it, satisfying postingsIterator.
+type fakePostingsIterator struct {
+	docs    []doc.Document
+	idx     int
+	lists   []postings.List
+	closers []io.Closer
+}
+
+func (it *fakePostingsIterator) Next() bool {
+	if it.idx >= len(it.docs) {
+		return false
+	}
+	it.idx++
+	return true
+}
+
+func (it *fakePostingsIterator) Current() doc.Document { return it.docs[it.idx-1] }
+func (it *fakePostingsIterator) Err() error            { return nil }
+func (it *fakePostingsIterator) Close() error          { return nil }
+func (it *fakePostingsIterator) Postings() ([]postings.List, []io.Closer) {
+	return it.lists, it.closers
+}
+
+// fakeReaderSetExecutor is a ReaderSetExecutor whose Generation can be bumped
+// mid-test to exercise cachedExecutor's generation handling.
+type fakeReaderSetExecutor struct {
+	generation            uint64
+	executeCalls          int
+	iterFromPostingsCalls int
+}
+
+func (e *fakeReaderSetExecutor) Generation() uint64 { return e.generation }
+
+func (e *fakeReaderSetExecutor) Execute(q Query) (doc.Iterator, error) {
+	e.executeCalls++
+	closer := &closerSpy{}
+	return &fakePostingsIterator{
+		docs:    []doc.Document{{}},
+		lists:   []postings.List{fixedSizePostingsList{size: 1}},
+		closers: []io.Closer{closer},
+	}, nil
+}
+
+func (e *fakeReaderSetExecutor) Close() error { return nil }
+
+func (e *fakeReaderSetExecutor) IteratorFromPostings(pls []postings.List) (doc.Iterator, error) {
+	e.iterFromPostingsCalls++
+	return &fakePostingsIterator{docs: []doc.Document{{}}, lists: pls}, nil
+}
+
+func TestCachedExecutorCachesResultsAcrossCalls(t *testing.T) {
+	exec := &fakeReaderSetExecutor{generation: 3001}
+	cached := NewExecutor(exec, WithQueryCache(1024))
+
+	q := fakeHashableQuery{hash: 7}
+
+	_, err := cached.Execute(q)
+	require.NoError(t, err)
+	_, err = cached.Execute(q)
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, exec.executeCalls)
+	assert.Equal(t, 1, exec.iterFromPostingsCalls)
+}
+
+func TestCachedExecutorSharesCacheAcrossConcurrentExecutors(t *testing.T) {
+	exec := &fakeReaderSetExecutor{generation: 3002}
+
+	a := NewExecutor(exec, WithQueryCache(1024))
+	b := NewExecutor(exec, WithQueryCache(1024))
+
+	q := fakeHashableQuery{hash: 9}
+
+	_, err := a.Execute(q)
+	require.NoError(t, err)
+	_, err = b.Execute(q)
+	require.NoError(t, err)
+
+	// b must observe a's cached entry rather than recomputing it.
+	assert.Equal(t, 1, exec.executeCalls)
+	assert.Equal(t, 1, exec.iterFromPostingsCalls)
+}
+
+func TestCachedExecutorInvalidatesOnGenerationChange(t *testing.T) {
+	exec := &fakeReaderSetExecutor{generation: 3003}
+	cached := NewExecutor(exec, WithQueryCache(1024))
+
+	q := fakeHashableQuery{hash: 11}
+
+	_, err := cached.Execute(q)
+	require.NoError(t, err)
+
+	exec.generation = 3004
+	_, err = cached.Execute(q)
+	require.NoError(t, err)
+
+	// The generation bump must force a recompute rather than reusing the
+	// prior generation's cached entry.
+	assert.Equal(t, 2, exec.executeCalls)
+	assert.Equal(t, 0, exec.iterFromPostingsCalls)
+}
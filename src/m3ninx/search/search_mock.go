@@ -20,170 +20,475 @@
 
 // Code generated by MockGen. DO NOT EDIT.
 // Source: github.com/m3db/m3ninx/search/types.go
+//
+// Generated by this command:
+//
+//	mockgen -package=search -destination=search_mock.go -source=types.go -typed
+//
 
+// Package search is a generated GoMock package.
 package search
 
 import (
-	"reflect"
+	io "io"
+	reflect "reflect"
 
-	"github.com/m3db/m3ninx/doc"
-	"github.com/m3db/m3ninx/index"
-	"github.com/m3db/m3ninx/postings"
+	doc "github.com/m3db/m3ninx/doc"
+	index "github.com/m3db/m3ninx/index"
+	postings "github.com/m3db/m3ninx/postings"
 
-	"github.com/golang/mock/gomock"
+	gomock "go.uber.org/mock/gomock"
 )
 
-// MockExecutor is a mock of Executor interface
+// MockExecutor is a mock of Executor interface.
 type MockExecutor struct {
 	ctrl     *gomock.Controller
 	recorder *MockExecutorMockRecorder
 }
 
-// MockExecutorMockRecorder is the mock recorder for MockExecutor
+// MockExecutorMockRecorder is the mock recorder for MockExecutor.
 type MockExecutorMockRecorder struct {
 	mock *MockExecutor
 }
 
-// NewMockExecutor creates a new mock instance
+// NewMockExecutor creates a new mock instance.
 func NewMockExecutor(ctrl *gomock.Controller) *MockExecutor {
 	mock := &MockExecutor{ctrl: ctrl}
 	mock.recorder = &MockExecutorMockRecorder{mock}
 	return mock
 }
 
-// EXPECT returns an object that allows the caller to indicate expected use
-func (_m *MockExecutor) EXPECT() *MockExecutorMockRecorder {
-	return _m.recorder
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockExecutor) EXPECT() *MockExecutorMockRecorder {
+	return m.recorder
+}
+
+// Close mocks base method.
+func (m *MockExecutor) Close() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Close")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Close indicates an expected call of Close.
+func (mr *MockExecutorMockRecorder) Close() *MockExecutorCloseCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockExecutor)(nil).Close))
+	return &MockExecutorCloseCall{Call: call}
+}
+
+// MockExecutorCloseCall wrap *gomock.Call
+type MockExecutorCloseCall struct {
+	*gomock.Call
 }
 
-// Execute mocks base method
-func (_m *MockExecutor) Execute(q Query) (doc.Iterator, error) {
-	ret := _m.ctrl.Call(_m, "Execute", q)
+// Return rewrite *gomock.Call.Return
+func (c *MockExecutorCloseCall) Return(arg0 error) *MockExecutorCloseCall {
+	c.Call = c.Call.Return(arg0)
+	return c
+}
+
+// Do rewrite *gomock.Call.Do
+func (c *MockExecutorCloseCall) Do(f func() error) *MockExecutorCloseCall {
+	c.Call = c.Call.Do(f)
+	return c
+}
+
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockExecutorCloseCall) DoAndReturn(f func() error) *MockExecutorCloseCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
+
+// Execute mocks base method.
+func (m *MockExecutor) Execute(q Query) (doc.Iterator, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Execute", q)
 	ret0, _ := ret[0].(doc.Iterator)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// Execute indicates an expected call of Execute
-func (_mr *MockExecutorMockRecorder) Execute(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Execute", reflect.TypeOf((*MockExecutor)(nil).Execute), arg0)
+// Execute indicates an expected call of Execute.
+func (mr *MockExecutorMockRecorder) Execute(q any) *MockExecutorExecuteCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Execute", reflect.TypeOf((*MockExecutor)(nil).Execute), q)
+	return &MockExecutorExecuteCall{Call: call}
 }
 
-// Close mocks base method
-func (_m *MockExecutor) Close() error {
-	ret := _m.ctrl.Call(_m, "Close")
-	ret0, _ := ret[0].(error)
-	return ret0
+// MockExecutorExecuteCall wrap *gomock.Call
+type MockExecutorExecuteCall struct {
+	*gomock.Call
+}
+
+// Return rewrite *gomock.Call.Return
+func (c *MockExecutorExecuteCall) Return(arg0 doc.Iterator, arg1 error) *MockExecutorExecuteCall {
+	c.Call = c.Call.Return(arg0, arg1)
+	return c
 }
 
-// Close indicates an expected call of Close
-func (_mr *MockExecutorMockRecorder) Close() *gomock.Call {
-	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Close", reflect.TypeOf((*MockExecutor)(nil).Close))
+// Do rewrite *gomock.Call.Do
+func (c *MockExecutorExecuteCall) Do(f func(Query) (doc.Iterator, error)) *MockExecutorExecuteCall {
+	c.Call = c.Call.Do(f)
+	return c
 }
 
-// MockQuery is a mock of Query interface
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockExecutorExecuteCall) DoAndReturn(f func(Query) (doc.Iterator, error)) *MockExecutorExecuteCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
+
+// MockQuery is a mock of Query interface.
 type MockQuery struct {
 	ctrl     *gomock.Controller
 	recorder *MockQueryMockRecorder
 }
 
-// MockQueryMockRecorder is the mock recorder for MockQuery
+// MockQueryMockRecorder is the mock recorder for MockQuery.
 type MockQueryMockRecorder struct {
 	mock *MockQuery
 }
 
-// NewMockQuery creates a new mock instance
+// NewMockQuery creates a new mock instance.
 func NewMockQuery(ctrl *gomock.Controller) *MockQuery {
 	mock := &MockQuery{ctrl: ctrl}
 	mock.recorder = &MockQueryMockRecorder{mock}
 	return mock
 }
 
-// EXPECT returns an object that allows the caller to indicate expected use
-func (_m *MockQuery) EXPECT() *MockQueryMockRecorder {
-	return _m.recorder
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockQuery) EXPECT() *MockQueryMockRecorder {
+	return m.recorder
+}
+
+// Hash mocks base method.
+func (m *MockQuery) Hash() uint64 {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Hash")
+	ret0, _ := ret[0].(uint64)
+	return ret0
+}
+
+// Hash indicates an expected call of Hash.
+func (mr *MockQueryMockRecorder) Hash() *MockQueryHashCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Hash", reflect.TypeOf((*MockQuery)(nil).Hash))
+	return &MockQueryHashCall{Call: call}
+}
+
+// MockQueryHashCall wrap *gomock.Call
+type MockQueryHashCall struct {
+	*gomock.Call
+}
+
+// Return rewrite *gomock.Call.Return
+func (c *MockQueryHashCall) Return(arg0 uint64) *MockQueryHashCall {
+	c.Call = c.Call.Return(arg0)
+	return c
+}
+
+// Do rewrite *gomock.Call.Do
+func (c *MockQueryHashCall) Do(f func() uint64) *MockQueryHashCall {
+	c.Call = c.Call.Do(f)
+	return c
 }
 
-// Searcher mocks base method
-func (_m *MockQuery) Searcher(rs index.Readers) (Searcher, error) {
-	ret := _m.ctrl.Call(_m, "Searcher", rs)
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockQueryHashCall) DoAndReturn(f func() uint64) *MockQueryHashCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
+
+// Searcher mocks base method.
+func (m *MockQuery) Searcher(rs index.Readers) (Searcher, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Searcher", rs)
 	ret0, _ := ret[0].(Searcher)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// Searcher indicates an expected call of Searcher
-func (_mr *MockQueryMockRecorder) Searcher(arg0 interface{}) *gomock.Call {
-	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Searcher", reflect.TypeOf((*MockQuery)(nil).Searcher), arg0)
+// Searcher indicates an expected call of Searcher.
+func (mr *MockQueryMockRecorder) Searcher(rs any) *MockQuerySearcherCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Searcher", reflect.TypeOf((*MockQuery)(nil).Searcher), rs)
+	return &MockQuerySearcherCall{Call: call}
+}
+
+// MockQuerySearcherCall wrap *gomock.Call
+type MockQuerySearcherCall struct {
+	*gomock.Call
 }
 
-// MockSearcher is a mock of Searcher interface
+// Return rewrite *gomock.Call.Return
+func (c *MockQuerySearcherCall) Return(arg0 Searcher, arg1 error) *MockQuerySearcherCall {
+	c.Call = c.Call.Return(arg0, arg1)
+	return c
+}
+
+// Do rewrite *gomock.Call.Do
+func (c *MockQuerySearcherCall) Do(f func(index.Readers) (Searcher, error)) *MockQuerySearcherCall {
+	c.Call = c.Call.Do(f)
+	return c
+}
+
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockQuerySearcherCall) DoAndReturn(f func(index.Readers) (Searcher, error)) *MockQuerySearcherCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
+
+// MockSearcher is a mock of Searcher interface.
 type MockSearcher struct {
 	ctrl     *gomock.Controller
 	recorder *MockSearcherMockRecorder
 }
 
-// MockSearcherMockRecorder is the mock recorder for MockSearcher
+// MockSearcherMockRecorder is the mock recorder for MockSearcher.
 type MockSearcherMockRecorder struct {
 	mock *MockSearcher
 }
 
-// NewMockSearcher creates a new mock instance
+// NewMockSearcher creates a new mock instance.
 func NewMockSearcher(ctrl *gomock.Controller) *MockSearcher {
 	mock := &MockSearcher{ctrl: ctrl}
 	mock.recorder = &MockSearcherMockRecorder{mock}
 	return mock
 }
 
-// EXPECT returns an object that allows the caller to indicate expected use
-func (_m *MockSearcher) EXPECT() *MockSearcherMockRecorder {
-	return _m.recorder
+// EXPECT returns an object that allows the caller to indicate expected use.
+func (m *MockSearcher) EXPECT() *MockSearcherMockRecorder {
+	return m.recorder
 }
 
-// Next mocks base method
-func (_m *MockSearcher) Next() bool {
-	ret := _m.ctrl.Call(_m, "Next")
-	ret0, _ := ret[0].(bool)
+// Current mocks base method.
+func (m *MockSearcher) Current() postings.List {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Current")
+	ret0, _ := ret[0].(postings.List)
 	return ret0
 }
 
-// Next indicates an expected call of Next
-func (_mr *MockSearcherMockRecorder) Next() *gomock.Call {
-	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Next", reflect.TypeOf((*MockSearcher)(nil).Next))
+// Current indicates an expected call of Current.
+func (mr *MockSearcherMockRecorder) Current() *MockSearcherCurrentCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Current", reflect.TypeOf((*MockSearcher)(nil).Current))
+	return &MockSearcherCurrentCall{Call: call}
+}
+
+// MockSearcherCurrentCall wrap *gomock.Call
+type MockSearcherCurrentCall struct {
+	*gomock.Call
+}
+
+// Return rewrite *gomock.Call.Return
+func (c *MockSearcherCurrentCall) Return(arg0 postings.List) *MockSearcherCurrentCall {
+	c.Call = c.Call.Return(arg0)
+	return c
+}
+
+// Do rewrite *gomock.Call.Do
+func (c *MockSearcherCurrentCall) Do(f func() postings.List) *MockSearcherCurrentCall {
+	c.Call = c.Call.Do(f)
+	return c
+}
+
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockSearcherCurrentCall) DoAndReturn(f func() postings.List) *MockSearcherCurrentCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
 }
 
-// Current mocks base method
-func (_m *MockSearcher) Current() postings.List {
-	ret := _m.ctrl.Call(_m, "Current")
+// CurrentP mocks base method.
+func (m *MockSearcher) CurrentP() (postings.List, io.Closer, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CurrentP")
 	ret0, _ := ret[0].(postings.List)
-	return ret0
+	ret1, _ := ret[1].(io.Closer)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// CurrentP indicates an expected call of CurrentP.
+func (mr *MockSearcherMockRecorder) CurrentP() *MockSearcherCurrentPCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CurrentP", reflect.TypeOf((*MockSearcher)(nil).CurrentP))
+	return &MockSearcherCurrentPCall{Call: call}
+}
+
+// MockSearcherCurrentPCall wrap *gomock.Call
+type MockSearcherCurrentPCall struct {
+	*gomock.Call
+}
+
+// Return rewrite *gomock.Call.Return
+func (c *MockSearcherCurrentPCall) Return(arg0 postings.List, arg1 io.Closer, arg2 error) *MockSearcherCurrentPCall {
+	c.Call = c.Call.Return(arg0, arg1, arg2)
+	return c
 }
 
-// Current indicates an expected call of Current
-func (_mr *MockSearcherMockRecorder) Current() *gomock.Call {
-	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Current", reflect.TypeOf((*MockSearcher)(nil).Current))
+// Do rewrite *gomock.Call.Do
+func (c *MockSearcherCurrentPCall) Do(f func() (postings.List, io.Closer, error)) *MockSearcherCurrentPCall {
+	c.Call = c.Call.Do(f)
+	return c
 }
 
-// Err mocks base method
-func (_m *MockSearcher) Err() error {
-	ret := _m.ctrl.Call(_m, "Err")
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockSearcherCurrentPCall) DoAndReturn(f func() (postings.List, io.Closer, error)) *MockSearcherCurrentPCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
+
+// Err mocks base method.
+func (m *MockSearcher) Err() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Err")
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Err indicates an expected call of Err
-func (_mr *MockSearcherMockRecorder) Err() *gomock.Call {
-	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "Err", reflect.TypeOf((*MockSearcher)(nil).Err))
+// Err indicates an expected call of Err.
+func (mr *MockSearcherMockRecorder) Err() *MockSearcherErrCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Err", reflect.TypeOf((*MockSearcher)(nil).Err))
+	return &MockSearcherErrCall{Call: call}
+}
+
+// MockSearcherErrCall wrap *gomock.Call
+type MockSearcherErrCall struct {
+	*gomock.Call
+}
+
+// Return rewrite *gomock.Call.Return
+func (c *MockSearcherErrCall) Return(arg0 error) *MockSearcherErrCall {
+	c.Call = c.Call.Return(arg0)
+	return c
+}
+
+// Do rewrite *gomock.Call.Do
+func (c *MockSearcherErrCall) Do(f func() error) *MockSearcherErrCall {
+	c.Call = c.Call.Do(f)
+	return c
+}
+
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockSearcherErrCall) DoAndReturn(f func() error) *MockSearcherErrCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
+
+// Next mocks base method.
+func (m *MockSearcher) Next() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Next")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Next indicates an expected call of Next.
+func (mr *MockSearcherMockRecorder) Next() *MockSearcherNextCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Next", reflect.TypeOf((*MockSearcher)(nil).Next))
+	return &MockSearcherNextCall{Call: call}
+}
+
+// MockSearcherNextCall wrap *gomock.Call
+type MockSearcherNextCall struct {
+	*gomock.Call
+}
+
+// Return rewrite *gomock.Call.Return
+func (c *MockSearcherNextCall) Return(arg0 bool) *MockSearcherNextCall {
+	c.Call = c.Call.Return(arg0)
+	return c
+}
+
+// Do rewrite *gomock.Call.Do
+func (c *MockSearcherNextCall) Do(f func() bool) *MockSearcherNextCall {
+	c.Call = c.Call.Do(f)
+	return c
+}
+
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockSearcherNextCall) DoAndReturn(f func() bool) *MockSearcherNextCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
+
+// NextP mocks base method.
+func (m *MockSearcher) NextP() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NextP")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// NextP indicates an expected call of NextP.
+func (mr *MockSearcherMockRecorder) NextP() *MockSearcherNextPCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NextP", reflect.TypeOf((*MockSearcher)(nil).NextP))
+	return &MockSearcherNextPCall{Call: call}
+}
+
+// MockSearcherNextPCall wrap *gomock.Call
+type MockSearcherNextPCall struct {
+	*gomock.Call
+}
+
+// Return rewrite *gomock.Call.Return
+func (c *MockSearcherNextPCall) Return(arg0 bool) *MockSearcherNextPCall {
+	c.Call = c.Call.Return(arg0)
+	return c
 }
 
-// NumReaders mocks base method
-func (_m *MockSearcher) NumReaders() int {
-	ret := _m.ctrl.Call(_m, "NumReaders")
+// Do rewrite *gomock.Call.Do
+func (c *MockSearcherNextPCall) Do(f func() bool) *MockSearcherNextPCall {
+	c.Call = c.Call.Do(f)
+	return c
+}
+
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockSearcherNextPCall) DoAndReturn(f func() bool) *MockSearcherNextPCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
+
+// NumReaders mocks base method.
+func (m *MockSearcher) NumReaders() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NumReaders")
 	ret0, _ := ret[0].(int)
 	return ret0
 }
 
-// NumReaders indicates an expected call of NumReaders
-func (_mr *MockSearcherMockRecorder) NumReaders() *gomock.Call {
-	return _mr.mock.ctrl.RecordCallWithMethodType(_mr.mock, "NumReaders", reflect.TypeOf((*MockSearcher)(nil).NumReaders))
-}
\ No newline at end of file
+// NumReaders indicates an expected call of NumReaders.
+func (mr *MockSearcherMockRecorder) NumReaders() *MockSearcherNumReadersCall {
+	mr.mock.ctrl.T.Helper()
+	call := mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NumReaders", reflect.TypeOf((*MockSearcher)(nil).NumReaders))
+	return &MockSearcherNumReadersCall{Call: call}
+}
+
+// MockSearcherNumReadersCall wrap *gomock.Call
+type MockSearcherNumReadersCall struct {
+	*gomock.Call
+}
+
+// Return rewrite *gomock.Call.Return
+func (c *MockSearcherNumReadersCall) Return(arg0 int) *MockSearcherNumReadersCall {
+	c.Call = c.Call.Return(arg0)
+	return c
+}
+
+// Do rewrite *gomock.Call.Do
+func (c *MockSearcherNumReadersCall) Do(f func() int) *MockSearcherNumReadersCall {
+	c.Call = c.Call.Do(f)
+	return c
+}
+
+// DoAndReturn rewrite *gomock.Call.DoAndReturn
+func (c *MockSearcherNumReadersCall) DoAndReturn(f func() int) *MockSearcherNumReadersCall {
+	c.Call = c.Call.DoAndReturn(f)
+	return c
+}
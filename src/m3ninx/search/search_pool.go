@@ -0,0 +1,264 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/m3db/m3ninx/doc"
+	"github.com/m3db/m3ninx/index"
+	"github.com/m3db/m3ninx/postings"
+)
+
+// SearcherP is a Searcher that can also lease its current postings list from
+// a pool instead of allocating it fresh, mirroring the value/pooled split of
+// an encode/decode API such as goka's CodecP. Implementations backed by
+// roaring bitmaps can use this to recycle containers and iterator scratch
+// buffers across queries.
+type SearcherP interface {
+	Searcher
+
+	// NextP advances the searcher, leasing any postings buffers it needs
+	// from a pool rather than allocating them. It is otherwise equivalent
+	// to Next.
+	NextP() bool
+
+	// CurrentP returns the current postings list along with an io.Closer
+	// that must be called exactly once, after the list is no longer
+	// needed, to return any leased buffers to their pool. The list must
+	// not be accessed after its closer has been called.
+	CurrentP() (postings.List, io.Closer, error)
+}
+
+// convertOrWrap returns s unchanged if it already implements SearcherP,
+// otherwise it wraps s so that NextP and CurrentP delegate to Next and
+// Current with a no-op closer. This lets callers always use the SearcherP
+// API without requiring every Searcher implementation to support pooling.
+func convertOrWrap(s Searcher) SearcherP {
+	if sp, ok := s.(SearcherP); ok {
+		return sp
+	}
+	return nonPoolingSearcher{s}
+}
+
+type nonPoolingSearcher struct {
+	Searcher
+}
+
+func (s nonPoolingSearcher) NextP() bool {
+	return s.Next()
+}
+
+func (s nonPoolingSearcher) CurrentP() (postings.List, io.Closer, error) {
+	return s.Current(), noopCloser{}, nil
+}
+
+type noopCloser struct{}
+
+func (noopCloser) Close() error { return nil }
+
+// PostingsListPool leases reusable postings.List values, allowing a
+// SearcherP implementation to recycle roaring bitmap containers and other
+// scratch buffers across queries instead of allocating a new postings.List
+// on every call to NextP/CurrentP.
+type PostingsListPool struct {
+	pool sync.Pool
+}
+
+// NewPostingsListPool returns a new PostingsListPool that constructs a new
+// postings.List with newFn whenever the pool has none available to reuse.
+func NewPostingsListPool(newFn func() postings.List) *PostingsListPool {
+	return &PostingsListPool{
+		pool: sync.Pool{
+			New: func() interface{} { return newFn() },
+		},
+	}
+}
+
+// Get leases a postings.List from the pool.
+func (p *PostingsListPool) Get() postings.List {
+	return p.pool.Get().(postings.List)
+}
+
+// Put returns a postings.List to the pool so it can be leased again. Callers
+// must reset the list before returning it if its contents should not be
+// visible to the next lease.
+//
+// PostingsListPool is meant to be embedded in an index reader's SearcherP
+// implementation, which leases from it in CurrentP and returns leases to it
+// via the io.Closer CurrentP hands back; see PoolingExecutor below for the
+// caller side of that contract.
+func (p *PostingsListPool) Put(pl postings.List) {
+	p.pool.Put(pl)
+}
+
+// errSearcherReaderMismatch indicates a Searcher yielded more per-reader
+// postings lists than PoolingExecutor has readers to satisfy them with.
+var errSearcherReaderMismatch = errors.New("searcher yielded results for more readers than were queried")
+
+// PoolingExecutor is an Executor that answers a query by draining its
+// Searcher through the pooled SearcherP path: for every per-reader postings
+// list NextP/CurrentP yields, it asks the corresponding index.Reader to
+// resolve the matching documents, and it always invokes the lease's closer
+// once the list is no longer needed so a pooling SearcherP implementation
+// can recycle its buffers across queries instead of allocating fresh ones
+// on every Execute.
+type PoolingExecutor struct {
+	readers index.Readers
+}
+
+// NewPoolingExecutor returns a PoolingExecutor that answers queries against
+// readers.
+func NewPoolingExecutor(readers index.Readers) *PoolingExecutor {
+	return &PoolingExecutor{readers: readers}
+}
+
+// Execute implements Executor.
+func (e *PoolingExecutor) Execute(q Query) (doc.Iterator, error) {
+	s, err := q.Searcher(e.readers)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := convertOrWrap(s)
+
+	iters := make([]doc.Iterator, 0, len(e.readers))
+	lists := make([]postings.List, 0, len(e.readers))
+	closers := make([]io.Closer, 0, len(e.readers))
+	for i := 0; sp.NextP(); i++ {
+		pl, closer, err := sp.CurrentP()
+		if err != nil {
+			closeLeases(closers)
+			return nil, err
+		}
+
+		if i >= len(e.readers) {
+			closer.Close()
+			closeLeases(closers)
+			return nil, errSearcherReaderMismatch
+		}
+
+		iter, err := e.readers[i].Docs(pl)
+		if err != nil {
+			closer.Close()
+			closeLeases(closers)
+			return nil, err
+		}
+
+		iters = append(iters, iter)
+		lists = append(lists, pl)
+		closers = append(closers, closer)
+	}
+
+	// The loop only leased up to the point it stopped at, so any error
+	// here still leaves every lease taken so far needing release - CurrentP
+	// promises each one's closer is called exactly once, and nothing past
+	// this point will do so for us.
+	if err := sp.Err(); err != nil {
+		closeLeases(closers)
+		return nil, err
+	}
+
+	return &pooledDocIterator{iters: iters, lists: lists, closers: closers}, nil
+}
+
+// closeLeases releases every lease in closers. It's used both on
+// PoolingExecutor.Execute's error paths, where a mid-loop failure must not
+// leak the buffers already leased for earlier readers, and by
+// pooledDocIterator's own Close.
+func closeLeases(closers []io.Closer) {
+	for _, closer := range closers {
+		closer.Close()
+	}
+}
+
+// Close implements Executor.
+func (e *PoolingExecutor) Close() error {
+	return nil
+}
+
+// pooledDocIterator concatenates the per-reader document iterators produced
+// by PoolingExecutor's Execute and retains the postings.List/closer leases
+// behind them.
+type pooledDocIterator struct {
+	iters   []doc.Iterator
+	lists   []postings.List
+	closers []io.Closer
+	current int
+	claimed bool
+}
+
+// Next implements doc.Iterator.
+func (it *pooledDocIterator) Next() bool {
+	for it.current < len(it.iters) {
+		if it.iters[it.current].Next() {
+			return true
+		}
+		it.current++
+	}
+	return false
+}
+
+// Current implements doc.Iterator.
+func (it *pooledDocIterator) Current() doc.Document {
+	return it.iters[it.current].Current()
+}
+
+// Err implements doc.Iterator.
+func (it *pooledDocIterator) Err() error {
+	if it.current < len(it.iters) {
+		return it.iters[it.current].Err()
+	}
+	return nil
+}
+
+// Close implements doc.Iterator. If the postings leases backing this
+// iterator have not been claimed by a caller via Postings (e.g. a query
+// cache that wants to hold them past this Close), their closers are invoked
+// here, once, so a caller that never calls Postings still releases them.
+func (it *pooledDocIterator) Close() error {
+	var err error
+	for _, iter := range it.iters {
+		if cerr := iter.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	if !it.claimed {
+		it.releaseLeases()
+	}
+
+	return err
+}
+
+// Postings returns the postings.List leased per reader along with the
+// closers that release them, transferring responsibility for eventually
+// calling those closers to the caller.
+func (it *pooledDocIterator) Postings() ([]postings.List, []io.Closer) {
+	it.claimed = true
+	return it.lists, it.closers
+}
+
+func (it *pooledDocIterator) releaseLeases() {
+	closeLeases(it.closers)
+}
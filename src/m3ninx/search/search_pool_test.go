@@ -0,0 +1,267 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/m3db/m3ninx/doc"
+	"github.com/m3db/m3ninx/index"
+	"github.com/m3db/m3ninx/postings"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakePostingsList struct{ n int }
+
+func (l fakePostingsList) Len() int { return l.n }
+
+type fakeSearcher struct {
+	lists      []fakePostingsList
+	idx        int
+	numReaders int
+}
+
+func (s *fakeSearcher) Next() bool {
+	if s.idx >= len(s.lists) {
+		return false
+	}
+	s.idx++
+	return true
+}
+
+func (s *fakeSearcher) Current() postings.List { return s.lists[s.idx-1] }
+func (s *fakeSearcher) Err() error             { return nil }
+func (s *fakeSearcher) NumReaders() int        { return s.numReaders }
+
+func TestConvertOrWrapPassesThroughSearcherP(t *testing.T) {
+	var sp SearcherP = convertOrWrap(&fakePoolingSearcher{})
+	_, ok := sp.(*fakePoolingSearcher)
+	assert.True(t, ok)
+}
+
+type fakePoolingSearcher struct{ fakeSearcher }
+
+func (s *fakePoolingSearcher) NextP() bool { return s.Next() }
+func (s *fakePoolingSearcher) CurrentP() (postings.List, io.Closer, error) {
+	return s.Current(), noopCloser{}, nil
+}
+
+func TestConvertOrWrapWrapsPlainSearcher(t *testing.T) {
+	s := &fakeSearcher{lists: []fakePostingsList{{n: 3}}}
+	sp := convertOrWrap(s)
+
+	require.True(t, sp.NextP())
+	pl, closer, err := sp.CurrentP()
+	require.NoError(t, err)
+	assert.Equal(t, 3, pl.Len())
+	assert.NoError(t, closer.Close())
+	assert.False(t, sp.NextP())
+}
+
+func TestPostingsListPoolReusesValues(t *testing.T) {
+	news := 0
+	pool := NewPostingsListPool(func() postings.List {
+		news++
+		return &fakePostingsList{}
+	})
+
+	first := pool.Get()
+	pool.Put(first)
+	second := pool.Get()
+
+	assert.Equal(t, 1, news)
+	assert.Same(t, first, second)
+}
+
+type fakeReader struct{ docs []doc.Document }
+
+func (r fakeReader) Docs(pl postings.List) (doc.Iterator, error) {
+	return &fakeDocIterator{docs: r.docs}, nil
+}
+
+type fakeDocIterator struct {
+	docs   []doc.Document
+	idx    int
+	closed bool
+}
+
+func (it *fakeDocIterator) Next() bool {
+	if it.idx >= len(it.docs) {
+		return false
+	}
+	it.idx++
+	return true
+}
+
+func (it *fakeDocIterator) Current() doc.Document { return it.docs[it.idx-1] }
+func (it *fakeDocIterator) Err() error            { return nil }
+func (it *fakeDocIterator) Close() error          { it.closed = true; return nil }
+
+type fakeQuery struct{ numReaders int }
+
+func (q fakeQuery) Searcher(rs index.Readers) (Searcher, error) {
+	lists := make([]fakePostingsList, q.numReaders)
+	for i := range lists {
+		lists[i] = fakePostingsList{n: i + 1}
+	}
+	return &fakePoolingSearcher{fakeSearcher{lists: lists, numReaders: q.numReaders}}, nil
+}
+
+func TestPoolingExecutorInvokesClosersOnClose(t *testing.T) {
+	readers := index.Readers{
+		fakeReader{docs: []doc.Document{{}}},
+		fakeReader{docs: []doc.Document{{}, {}}},
+	}
+
+	exec := NewPoolingExecutor(readers)
+	iter, err := exec.Execute(fakeQuery{numReaders: 2})
+	require.NoError(t, err)
+
+	count := 0
+	for iter.Next() {
+		count++
+	}
+	require.NoError(t, iter.Err())
+	assert.Equal(t, 3, count)
+
+	require.NoError(t, iter.Close())
+
+	pooled, ok := iter.(*pooledDocIterator)
+	require.True(t, ok)
+	for _, it := range pooled.iters {
+		assert.True(t, it.(*fakeDocIterator).closed)
+	}
+}
+
+func TestPoolingExecutorPostingsClaimTransfersCloserResponsibility(t *testing.T) {
+	readers := index.Readers{fakeReader{docs: []doc.Document{{}}}}
+
+	exec := NewPoolingExecutor(readers)
+	iter, err := exec.Execute(fakeQuery{numReaders: 1})
+	require.NoError(t, err)
+
+	pooled := iter.(*pooledDocIterator)
+	lists, closers := pooled.Postings()
+	require.Len(t, lists, 1)
+	require.Len(t, closers, 1)
+
+	// Close must not release the claimed leases a second time; the cache
+	// (or whatever claimed them) owns that now.
+	require.NoError(t, iter.Close())
+}
+
+// spyPoolingSearcher is a SearcherP whose CurrentP hands back a closerSpy
+// per call, so a test can assert every lease taken before an error was hit
+// still gets released, and an optional trailErr to exercise the trailing
+// sp.Err() error path.
+type spyPoolingSearcher struct {
+	fakeSearcher
+	closers  []*closerSpy
+	trailErr error
+}
+
+func (s *spyPoolingSearcher) NextP() bool { return s.Next() }
+
+func (s *spyPoolingSearcher) CurrentP() (postings.List, io.Closer, error) {
+	closer := &closerSpy{}
+	s.closers = append(s.closers, closer)
+	return s.Current(), closer, nil
+}
+
+func (s *spyPoolingSearcher) Err() error { return s.trailErr }
+
+type fakeQueryFromSearcher struct{ searcher SearcherP }
+
+func (q fakeQueryFromSearcher) Searcher(rs index.Readers) (Searcher, error) {
+	return q.searcher, nil
+}
+
+type erroringReader struct{ err error }
+
+func (r erroringReader) Docs(pl postings.List) (doc.Iterator, error) {
+	return nil, r.err
+}
+
+func TestPoolingExecutorReleasesAlreadyLeasedClosersOnReaderError(t *testing.T) {
+	errReaderFailure := errors.New("reader failure")
+	readers := index.Readers{
+		fakeReader{docs: []doc.Document{{}}},
+		erroringReader{err: errReaderFailure},
+	}
+
+	searcher := &spyPoolingSearcher{fakeSearcher: fakeSearcher{
+		lists:      []fakePostingsList{{n: 1}, {n: 1}},
+		numReaders: 2,
+	}}
+
+	exec := NewPoolingExecutor(readers)
+	_, err := exec.Execute(fakeQueryFromSearcher{searcher: searcher})
+	require.Equal(t, errReaderFailure, err)
+
+	// Both the reader that failed and every reader leased before it must
+	// have their closer released; none of them may leak back out of the
+	// pool.
+	require.Len(t, searcher.closers, 2)
+	for _, c := range searcher.closers {
+		assert.Equal(t, 1, c.closes)
+	}
+}
+
+func TestPoolingExecutorReleasesLeasesOnReaderCountMismatch(t *testing.T) {
+	readers := index.Readers{fakeReader{docs: []doc.Document{{}}}}
+
+	// The searcher yields two postings lists, but there's only one reader
+	// to resolve them against.
+	searcher := &spyPoolingSearcher{fakeSearcher: fakeSearcher{
+		lists:      []fakePostingsList{{n: 1}, {n: 1}},
+		numReaders: 2,
+	}}
+
+	exec := NewPoolingExecutor(readers)
+	_, err := exec.Execute(fakeQueryFromSearcher{searcher: searcher})
+	require.Equal(t, errSearcherReaderMismatch, err)
+
+	require.Len(t, searcher.closers, 2)
+	for _, c := range searcher.closers {
+		assert.Equal(t, 1, c.closes)
+	}
+}
+
+func TestPoolingExecutorReleasesLeasesOnTrailingSearcherError(t *testing.T) {
+	errTrailing := errors.New("trailing searcher error")
+	readers := index.Readers{fakeReader{docs: []doc.Document{{}}}}
+
+	searcher := &spyPoolingSearcher{
+		fakeSearcher: fakeSearcher{lists: []fakePostingsList{{n: 1}}, numReaders: 1},
+		trailErr:     errTrailing,
+	}
+
+	exec := NewPoolingExecutor(readers)
+	_, err := exec.Execute(fakeQueryFromSearcher{searcher: searcher})
+	require.Equal(t, errTrailing, err)
+
+	require.Len(t, searcher.closers, 1)
+	assert.Equal(t, 1, searcher.closers[0].closes)
+}
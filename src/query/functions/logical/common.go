@@ -192,6 +192,38 @@ func DedupeMetadata(
 	return models.FromMap(commonTags), seriesMeta
 }
 
+// projectMatchingLabels returns a copy of seriesMeta where any of labels
+// that were hoisted out of every series into meta's shared Tags (see
+// combineMetaAndSeriesMeta) is copied back down onto each series' Tags.
+// meta and seriesMeta are left untouched; this only affects the copy it
+// returns, so callers that need the hoisted tag visible on a per-series
+// basis (such as matchSeries hashing on a matching label) don't have to
+// un-hoist it for real and risk disturbing later tag-combining logic.
+func projectMatchingLabels(
+	meta block.Metadata,
+	seriesMeta []block.SeriesMeta,
+	labels []string,
+) []block.SeriesMeta {
+	var hoisted models.Tags
+	for _, name := range labels {
+		if v, ok := meta.Tags.Get(name); ok {
+			hoisted = append(hoisted, models.Tag{Name: name, Value: v})
+		}
+	}
+
+	if len(hoisted) == 0 {
+		return seriesMeta
+	}
+
+	projected := make([]block.SeriesMeta, len(seriesMeta))
+	for i, sm := range seriesMeta {
+		projected[i] = sm
+		projected[i].Tags = sm.Tags.Add(hoisted)
+	}
+
+	return projected
+}
+
 func appendValuesAtIndices(idxArray []int, iter block.StepIter, builder block.Builder) error {
 	for index := 0; iter.Next(); index++ {
 		step, err := iter.Current()
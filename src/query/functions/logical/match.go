@@ -0,0 +1,224 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package logical
+
+import (
+	"errors"
+
+	"github.com/m3db/m3/src/query/block"
+	"github.com/m3db/m3/src/query/models"
+)
+
+var (
+	errManyToManyMatch = errors.New("many-to-many matching not allowed: " +
+		"matching labels must be unique on the one side")
+	errCardManyToMany = errors.New("many-to-many matching not allowed for " +
+		"this operator; only set operators support it")
+	errOneToOneAmbiguousMatch = errors.New("multiple matches for labels: " +
+		"many-to-one matching must be explicit (group_left/group_right)")
+)
+
+// seriesMatch pairs a series on the "many" side with the series it matched
+// on the "one" side, and the tags the resulting joined series should carry.
+type seriesMatch struct {
+	ManyIdx int
+	OneIdx  int
+	Tags    models.Tags
+}
+
+// matchSeries implements PromQL-style vector matching between a "one" side
+// and a "many" side: every series on the many side is grouped by
+// matching.On/matching.MatchingLabels and looked up in the one side's
+// groups; at most one one-side series may belong to any group, and a
+// many-side series with no matching group is dropped from the result.
+//
+// A one-side group may be claimed by more than one many-side series only
+// when matching.Card explicitly says so (CardManyToOne/CardOneToMany, i.e.
+// group_left/group_right); for plain CardOneToOne, a second many-side
+// series claiming a group already matched is an ambiguous match and errors,
+// exactly as PromQL's "multiple matches for labels" does.
+//
+// manyMeta/oneMeta are each side's block.Metadata, needed because a
+// matching label common to every series in a block is hoisted out of
+// SeriesMeta.Tags into Metadata.Tags (see combineMetaAndSeriesMeta); without
+// them, hashing manySide/oneSide's Tags directly would be blind to such a
+// label and could mistake every series for belonging to the same group.
+func matchSeries(
+	manyMeta, oneMeta block.Metadata,
+	manySide, oneSide []block.SeriesMeta,
+	matching VectorMatching,
+) ([]seriesMatch, error) {
+	hash := HashFunc(matching.On, matching.MatchingLabels...)
+
+	// Used only to compute group hashes; the original manySide/oneSide are
+	// still used below so a hoisted matching label isn't spuriously added
+	// to the series tags returned in the result.
+	hashOneSide := projectMatchingLabels(oneMeta, oneSide, matching.MatchingLabels)
+	hashManySide := projectMatchingLabels(manyMeta, manySide, matching.MatchingLabels)
+
+	oneGroups := make(map[uint64]int, len(hashOneSide))
+	for idx, meta := range hashOneSide {
+		key := hash(meta.Tags)
+		if _, found := oneGroups[key]; found {
+			return nil, errManyToManyMatch
+		}
+		oneGroups[key] = idx
+	}
+
+	matches := make([]seriesMatch, 0, len(manySide))
+	matchedOneIdx := make(map[int]bool, len(oneSide))
+	for manyIdx, meta := range manySide {
+		oneIdx, found := oneGroups[hash(hashManySide[manyIdx].Tags)]
+		if !found {
+			// No series on the one side shares this group; PromQL drops
+			// the unmatched many-side series rather than erroring.
+			continue
+		}
+
+		if matching.Card == CardOneToOne && matchedOneIdx[oneIdx] {
+			return nil, errOneToOneAmbiguousMatch
+		}
+		matchedOneIdx[oneIdx] = true
+
+		tags := meta.Tags
+		for _, name := range matching.Include {
+			if v, ok := oneSide[oneIdx].Tags.Get(name); ok {
+				tags = tags.Add(models.Tags{{Name: name, Value: v}})
+			}
+		}
+
+		matches = append(matches, seriesMatch{
+			ManyIdx: manyIdx,
+			OneIdx:  oneIdx,
+			Tags:    tags,
+		})
+	}
+
+	return matches, nil
+}
+
+// isMatchingLabel reports whether name is one of the labels the join keys
+// on, honoring the On/Ignoring toggle the same way HashFunc does.
+func isMatchingLabel(matching VectorMatching, name string) bool {
+	for _, l := range matching.MatchingLabels {
+		if l == name {
+			return matching.On
+		}
+	}
+	return !matching.On
+}
+
+// combineMetaForMatching computes the shared block.Metadata for a
+// VectorMatch result. Unlike combineMetaAndSeriesMeta, which treats any tag
+// shared by both sides as safe to hoist into shared Metadata, only tags
+// that are part of the join's matching predicate are hoisted here: with
+// group_left/group_right, many-side series from unrelated groups can
+// coincidentally share other tag values, and those must stay on the
+// individual SeriesMeta rather than be promoted to the block as a whole.
+func combineMetaForMatching(
+	meta, otherMeta block.Metadata,
+	seriesMeta []block.SeriesMeta,
+	matching VectorMatching,
+) (block.Metadata, []block.SeriesMeta) {
+	otherTags := otherMeta.Tags.TagMap()
+
+	tags := make(models.Tags, 0, len(meta.Tags))
+	tagsToAdd := make(models.Tags, 0, len(meta.Tags))
+	for _, t := range meta.Tags {
+		otherTag, sharedWithOtherSide := otherTags[t.Name]
+		if isMatchingLabel(matching, t.Name) && sharedWithOtherSide && otherTag.Value == t.Value {
+			tags = append(tags, t)
+			continue
+		}
+
+		tagsToAdd = append(tagsToAdd, t)
+	}
+
+	meta.Tags = tags
+	for i, sm := range seriesMeta {
+		seriesMeta[i].Tags = sm.Tags.Add(tagsToAdd)
+	}
+
+	return meta, seriesMeta
+}
+
+// VectorMatch joins the series of lhs and rhs according to matching,
+// implementing full PromQL vector matching semantics: CardOneToOne as
+// before, plus CardManyToOne/CardOneToMany with group_left/group_right
+// style label inclusion via matching.Include. CardManyToMany is rejected;
+// operators that allow many-to-many matching (the set operators AND/OR/
+// UNLESS) must join their operands directly rather than through VectorMatch.
+//
+// The returned block's series carry the many-side values verbatim; callers
+// combine them positionally against the matched one-side series (see
+// appendValuesAtIndices) once they know the arithmetic operator to apply.
+func VectorMatch(
+	lhs, rhs block.Block,
+	matching VectorMatching,
+) (block.Block, error) {
+	if matching.Card == CardManyToMany {
+		return nil, errCardManyToMany
+	}
+
+	if !lhs.Meta().Bounds.Equals(rhs.Meta().Bounds) {
+		return nil, errMismatchedBounds
+	}
+
+	manySide, oneSide, manyIsLHS := rhs, lhs, false
+	if matching.Card != CardOneToMany {
+		manySide, oneSide, manyIsLHS = lhs, rhs, true
+	}
+
+	manyMeta, oneMeta := lhs.Meta(), rhs.Meta()
+	if !manyIsLHS {
+		manyMeta, oneMeta = rhs.Meta(), lhs.Meta()
+	}
+
+	matches, err := matchSeries(manyMeta, oneMeta, manySide.SeriesMeta(), oneSide.SeriesMeta(), matching)
+	if err != nil {
+		return nil, err
+	}
+
+	seriesMeta := make([]block.SeriesMeta, 0, len(matches))
+	manyIndices := make([]int, 0, len(matches))
+	for _, m := range matches {
+		seriesMeta = append(seriesMeta, block.SeriesMeta{Tags: m.Tags})
+		manyIndices = append(manyIndices, m.ManyIdx)
+	}
+
+	meta, seriesMeta := combineMetaForMatching(manyMeta, oneMeta, seriesMeta, matching)
+
+	builder, err := block.NewBuilder(meta, seriesMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := manySide.StepIter()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := appendValuesAtIndices(manyIndices, iter, builder); err != nil {
+		return nil, err
+	}
+
+	return builder.Build()
+}
@@ -0,0 +1,307 @@
+// Copyright (c) 2018 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package logical
+
+import (
+	"testing"
+
+	"github.com/m3db/m3/src/query/block"
+	"github.com/m3db/m3/src/query/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func seriesMetaWithTags(tags ...string) block.SeriesMeta {
+	ts := make(models.Tags, 0, len(tags)/2)
+	for i := 0; i < len(tags); i += 2 {
+		ts = append(ts, models.Tag{Name: tags[i], Value: tags[i+1]})
+	}
+	return block.SeriesMeta{Tags: ts}
+}
+
+// noSharedMeta is passed to matchSeries in tests that don't exercise
+// hoisted shared tags, i.e. every matching label already lives on each
+// series's own SeriesMeta.Tags.
+var noSharedMeta = block.Metadata{}
+
+func TestMatchSeriesOnToggle(t *testing.T) {
+	many := []block.SeriesMeta{
+		seriesMetaWithTags("foo", "bar", "baz", "qux"),
+		seriesMetaWithTags("foo", "other", "baz", "qux"),
+	}
+	one := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "qux"),
+	}
+
+	matches, err := matchSeries(noSharedMeta, noSharedMeta, many, one, VectorMatching{
+		Card:           CardManyToOne,
+		On:             true,
+		MatchingLabels: []string{"baz"},
+	})
+	require.NoError(t, err)
+	require.Len(t, matches, 2)
+	assert.Equal(t, 0, matches[0].ManyIdx)
+	assert.Equal(t, 0, matches[0].OneIdx)
+	assert.Equal(t, 1, matches[1].ManyIdx)
+	assert.Equal(t, 0, matches[1].OneIdx)
+}
+
+func TestMatchSeriesIgnoring(t *testing.T) {
+	many := []block.SeriesMeta{
+		seriesMetaWithTags("foo", "bar", "baz", "qux"),
+	}
+	one := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "qux"),
+	}
+
+	matches, err := matchSeries(noSharedMeta, noSharedMeta, many, one, VectorMatching{
+		On:             false,
+		MatchingLabels: []string{"foo"},
+	})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+}
+
+func TestMatchSeriesEmptyGroupDropsManySide(t *testing.T) {
+	many := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "unmatched"),
+	}
+	one := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "qux"),
+	}
+
+	matches, err := matchSeries(noSharedMeta, noSharedMeta, many, one, VectorMatching{
+		On:             true,
+		MatchingLabels: []string{"baz"},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestMatchSeriesDuplicateOneSideErrors(t *testing.T) {
+	many := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "qux"),
+	}
+	one := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "qux", "extra", "a"),
+		seriesMetaWithTags("baz", "qux", "extra", "b"),
+	}
+
+	_, err := matchSeries(noSharedMeta, noSharedMeta, many, one, VectorMatching{
+		On:             true,
+		MatchingLabels: []string{"baz"},
+	})
+	assert.Equal(t, errManyToManyMatch, err)
+}
+
+func TestMatchSeriesOneToOneAmbiguousMatchErrors(t *testing.T) {
+	// Two many-side series both hash to the same (sole) one-side group; under
+	// plain CardOneToOne that's ambiguous and must error rather than letting
+	// the second series silently reuse the first's OneIdx.
+	many := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "qux", "instance", "a"),
+		seriesMetaWithTags("baz", "qux", "instance", "b"),
+	}
+	one := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "qux"),
+	}
+
+	_, err := matchSeries(noSharedMeta, noSharedMeta, many, one, VectorMatching{
+		Card:           CardOneToOne,
+		On:             true,
+		MatchingLabels: []string{"baz"},
+	})
+	assert.Equal(t, errOneToOneAmbiguousMatch, err)
+}
+
+func TestMatchSeriesIncludesOneSideLabels(t *testing.T) {
+	many := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "qux"),
+	}
+	one := []block.SeriesMeta{
+		seriesMetaWithTags("baz", "qux", "extra", "included"),
+	}
+
+	matches, err := matchSeries(noSharedMeta, noSharedMeta, many, one, VectorMatching{
+		On:             true,
+		MatchingLabels: []string{"baz"},
+		Include:        []string{"extra"},
+	})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+
+	v, ok := matches[0].Tags.Get("extra")
+	require.True(t, ok)
+	assert.Equal(t, "included", v)
+}
+
+func TestMatchSeriesMatchesOnLabelHoistedIntoSharedMeta(t *testing.T) {
+	// "dc" is common to every series in the one-side block, so it's been
+	// hoisted out of each SeriesMeta.Tags into the block's shared
+	// Metadata.Tags; it must still be visible to the match.
+	oneMeta := block.Metadata{Tags: models.Tags{{Name: "dc", Value: "east"}}}
+	many := []block.SeriesMeta{
+		seriesMetaWithTags("dc", "east"),
+	}
+	one := []block.SeriesMeta{
+		seriesMetaWithTags("extra", "a"),
+	}
+
+	matches, err := matchSeries(noSharedMeta, oneMeta, many, one, VectorMatching{
+		On:             true,
+		MatchingLabels: []string{"dc"},
+	})
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+	assert.Equal(t, 0, matches[0].ManyIdx)
+	assert.Equal(t, 0, matches[0].OneIdx)
+
+	// The hoisted label must not leak into the output tags: they should
+	// still be exactly the original many-side series's own tags.
+	assert.Equal(t, many[0].Tags, matches[0].Tags)
+}
+
+func TestMatchSeriesDuplicateOneSideErrorsWithHoistedLabel(t *testing.T) {
+	// Both one-side series share "dc" via the block's shared Metadata, and
+	// are otherwise identical on the matching label; two series hashing to
+	// the same group with no disambiguating label is a many-to-many match.
+	oneMeta := block.Metadata{Tags: models.Tags{{Name: "dc", Value: "east"}}}
+	many := []block.SeriesMeta{
+		seriesMetaWithTags("dc", "east"),
+	}
+	one := []block.SeriesMeta{
+		seriesMetaWithTags("extra", "a"),
+		seriesMetaWithTags("extra", "b"),
+	}
+
+	_, err := matchSeries(noSharedMeta, oneMeta, many, one, VectorMatching{
+		On:             true,
+		MatchingLabels: []string{"dc"},
+	})
+	assert.Equal(t, errManyToManyMatch, err)
+}
+
+func TestCombineMetaForMatchingKeepsOnlyMatchingLabelsShared(t *testing.T) {
+	meta := block.Metadata{
+		Tags: models.Tags{
+			{Name: "baz", Value: "qux"},
+			{Name: "region", Value: "east"},
+		},
+	}
+	otherMeta := block.Metadata{
+		Tags: models.Tags{
+			{Name: "baz", Value: "qux"},
+			{Name: "region", Value: "east"},
+		},
+	}
+	seriesMeta := []block.SeriesMeta{{Tags: models.Tags{}}}
+
+	combined, seriesMeta := combineMetaForMatching(meta, otherMeta, seriesMeta, VectorMatching{
+		On:             true,
+		MatchingLabels: []string{"baz"},
+	})
+
+	require.Len(t, combined.Tags, 1)
+	assert.Equal(t, "baz", combined.Tags[0].Name)
+
+	// region is common to both sides, but isn't part of the matching
+	// predicate, so it must be pushed down onto the series instead of
+	// being hoisted into the shared block metadata.
+	v, ok := seriesMeta[0].Tags.Get("region")
+	require.True(t, ok)
+	assert.Equal(t, "east", v)
+}
+
+// fakeStep is a block.Step backed by a fixed slice of per-series values.
+type fakeStep struct{ values []float64 }
+
+func (s fakeStep) Values() []float64 { return s.values }
+
+// fakeStepIter is a block.StepIter over a single fakeStep.
+type fakeStepIter struct {
+	step fakeStep
+	done bool
+}
+
+func (it *fakeStepIter) Next() bool {
+	if it.done {
+		return false
+	}
+	it.done = true
+	return true
+}
+
+func (it *fakeStepIter) Current() (block.Step, error) { return it.step, nil }
+
+// fakeBlock is a block.Block with a single step, backing the end-to-end
+// VectorMatch test below.
+type fakeBlock struct {
+	meta       block.Metadata
+	seriesMeta []block.SeriesMeta
+	values     []float64
+}
+
+func (b fakeBlock) Meta() block.Metadata           { return b.meta }
+func (b fakeBlock) SeriesMeta() []block.SeriesMeta { return b.seriesMeta }
+func (b fakeBlock) StepIter() (block.StepIter, error) {
+	return &fakeStepIter{step: fakeStep{values: b.values}}, nil
+}
+
+func TestVectorMatchAppliesHoistedMatchingLabel(t *testing.T) {
+	// rhs has a single series per "dc", with "dc" hoisted into the block's
+	// shared Metadata.Tags rather than living on each SeriesMeta.Tags.
+	lhs := fakeBlock{
+		meta: block.Metadata{},
+		seriesMeta: []block.SeriesMeta{
+			seriesMetaWithTags("dc", "east", "instance", "a"),
+			seriesMetaWithTags("dc", "west", "instance", "b"),
+		},
+		values: []float64{1, 2},
+	}
+	rhs := fakeBlock{
+		meta: block.Metadata{Tags: models.Tags{{Name: "dc", Value: "east"}}},
+		seriesMeta: []block.SeriesMeta{
+			seriesMetaWithTags(), // no per-series tags; "dc" only lives on meta
+		},
+		values: []float64{10},
+	}
+
+	result, err := VectorMatch(lhs, rhs, VectorMatching{
+		Card:           CardManyToOne,
+		On:             true,
+		MatchingLabels: []string{"dc"},
+	})
+	require.NoError(t, err)
+
+	// Only the lhs series sharing rhs's (hoisted) "dc": east should match.
+	require.Len(t, result.SeriesMeta(), 1)
+	v, ok := result.SeriesMeta()[0].Tags.Get("instance")
+	require.True(t, ok)
+	assert.Equal(t, "a", v)
+
+	iter, err := result.StepIter()
+	require.NoError(t, err)
+	require.True(t, iter.Next())
+	step, err := iter.Current()
+	require.NoError(t, err)
+	assert.Equal(t, []float64{1}, step.Values())
+}